@@ -0,0 +1,58 @@
+use std::net::IpAddr;
+
+use crate::auth::Permission;
+use crate::config::AclRule;
+
+/// Denied if any matching rule denies `ip`, or a matching allow list not contains `ip`
+pub fn allow(rules: &[AclRule], stream: &str, permission: Permission, ip: IpAddr) -> bool {
+    // Listen on [::] gets IPv4 clients as IPv4-mapped IPv6
+    let ip = match ip {
+        IpAddr::V6(v6) => v6.to_ipv4_mapped().map(IpAddr::V4).unwrap_or(ip),
+        IpAddr::V4(_) => ip,
+    };
+    rules
+        .iter()
+        .filter(|rule| stream.starts_with(&rule.prefix))
+        .filter(|rule| rule.permission.map_or(true, |p| p == permission))
+        .all(|rule| {
+            !rule.deny.iter().any(|net| net.contains(&ip))
+                && (rule.allow.is_empty() || rule.allow.iter().any(|net| net.contains(&ip)))
+        })
+}
+
+#[cfg(test)]
+mod test {
+    use crate::acl::allow;
+    use crate::auth::Permission;
+    use crate::config::AclRule;
+
+    #[test]
+    fn test_acl_allow() {
+        let rules = vec![
+            AclRule {
+                prefix: "".to_string(),
+                permission: Some(Permission::Publish),
+                allow: vec!["10.0.0.0/8".parse().unwrap()],
+                deny: vec![],
+            },
+            AclRule {
+                prefix: "private-".to_string(),
+                permission: None,
+                allow: vec![],
+                deny: vec!["192.0.2.0/24".parse().unwrap()],
+            },
+        ];
+        let studio = "10.1.2.3".parse().unwrap();
+        let public = "192.0.2.1".parse().unwrap();
+        assert!(allow(&rules, "777", Permission::Publish, studio));
+        assert!(!allow(&rules, "777", Permission::Publish, public));
+        assert!(allow(&rules, "777", Permission::Subscribe, public));
+        assert!(!allow(&rules, "private-777", Permission::Subscribe, public));
+        assert!(allow(
+            &rules,
+            "777",
+            Permission::Publish,
+            "::ffff:10.1.2.3".parse().unwrap()
+        ));
+    }
+}
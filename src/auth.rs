@@ -1,14 +1,189 @@
-use std::{collections::HashSet, marker::PhantomData};
+use std::{
+    collections::{HashMap, HashSet},
+    marker::PhantomData,
+    sync::{Arc, RwLock},
+    time::{SystemTime, UNIX_EPOCH},
+};
 
-use crate::config::Auth;
-use base64::{engine::general_purpose::STANDARD, Engine};
-use http::{header, Request, Response, StatusCode};
+use crate::config::{Auth, Tenant};
+use base64::{
+    engine::general_purpose::{STANDARD, URL_SAFE_NO_PAD},
+    Engine,
+};
+use hmac::{Hmac, Mac};
+use http::{header, HeaderMap, Method, Request, Response, StatusCode, Uri};
 use http_body::Body;
+use percent_encoding::{percent_decode_str, utf8_percent_encode, AsciiSet, NON_ALPHANUMERIC};
+use rand::{distributions::Alphanumeric, Rng};
+use serde::{Deserialize, Serialize};
+use sha2::Sha256;
 use tower_http::validate_request::ValidateRequest;
 
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Permission {
+    Publish,
+    Subscribe,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StreamToken {
+    pub token: String,
+    pub stream: String,
+    pub permission: Permission,
+    /// Unix timestamp in seconds, 0 is never expires
+    pub expires: u64,
+}
+
+impl StreamToken {
+    fn is_expired(&self, now: u64) -> bool {
+        self.expires != 0 && self.expires <= now
+    }
+}
+
+/// Tokens scoped to one stream and one permission, minted by the admin API
+#[derive(Debug, Clone, Default)]
+pub struct StreamTokens(Arc<RwLock<HashMap<String, StreamToken>>>);
+
+impl StreamTokens {
+    pub fn create(&self, stream: String, permission: Permission, ttl: u64) -> StreamToken {
+        let now = unix_now();
+        let token = StreamToken {
+            token: rand::thread_rng()
+                .sample_iter(&Alphanumeric)
+                .take(32)
+                .map(char::from)
+                .collect(),
+            stream,
+            permission,
+            expires: if ttl == 0 { 0 } else { now.saturating_add(ttl) },
+        };
+        let mut tokens = self.0.write().unwrap();
+        tokens.retain(|_, t| !t.is_expired(now));
+        tokens.insert(token.token.clone(), token.clone());
+        token
+    }
+
+    pub fn list(&self) -> Vec<StreamToken> {
+        let now = unix_now();
+        self.0
+            .read()
+            .unwrap()
+            .values()
+            .filter(|t| !t.is_expired(now))
+            .cloned()
+            .collect()
+    }
+
+    pub fn remove(&self, token: &str) -> bool {
+        self.0.write().unwrap().remove(token).is_some()
+    }
+
+    fn validate(&self, token: &str, stream: &str, permission: Permission) -> bool {
+        match self.0.read().unwrap().get(token) {
+            Some(t) => {
+                t.stream == stream && t.permission == permission && !t.is_expired(unix_now())
+            }
+            None => false,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SignedUrl {
+    pub url: String,
+    pub expires: u64,
+}
+
+/// Characters kept as is in a path segment, others are percent-encoded
+const SEGMENT: &AsciiSet = &NON_ALPHANUMERIC
+    .remove(b'-')
+    .remove(b'_')
+    .remove(b'.')
+    .remove(b'~');
+
+/// Stream of `/whip/:id`, `/whep/:id`, `/whep/:id/layer`, decoded the same as axum `Path`
+fn path_stream(path: &str) -> Option<String> {
+    let segment = path.split('/').nth(2)?;
+    percent_decode_str(segment)
+        .decode_utf8()
+        .ok()
+        .map(|stream| stream.into_owned())
+}
+
+/// WHEP playback URL valid until `now + ttl`
+pub fn sign_url(secret: &str, stream: &str, ttl: u64) -> SignedUrl {
+    let expires = unix_now().saturating_add(ttl);
+    SignedUrl {
+        url: format!(
+            "/whep/{}?expires={}&sig={}",
+            utf8_percent_encode(stream, SEGMENT),
+            expires,
+            signature(secret, stream, expires)
+        ),
+        expires,
+    }
+}
+
+fn mac(secret: &str, stream: &str, expires: u64) -> Hmac<Sha256> {
+    let mut mac =
+        Hmac::<Sha256>::new_from_slice(secret.as_bytes()).expect("HMAC can take key of any size");
+    mac.update(format!("{}:{}", stream, expires).as_bytes());
+    mac
+}
+
+fn signature(secret: &str, stream: &str, expires: u64) -> String {
+    URL_SAFE_NO_PAD.encode(mac(secret, stream, expires).finalize().into_bytes())
+}
+
+/// Expired URLs are still valid for the session created before, when `check_expires` is false
+fn verify_signed_url(secret: &str, uri: &Uri, check_expires: bool) -> bool {
+    let stream = match path_stream(uri.path()) {
+        Some(stream) => stream,
+        None => return false,
+    };
+    let (mut expires, mut sig) = (None, None);
+    for pair in uri.query().unwrap_or_default().split('&') {
+        match pair.split_once('=') {
+            Some(("expires", v)) => expires = v.parse::<u64>().ok(),
+            Some(("sig", v)) => sig = Some(v),
+            _ => {}
+        }
+    }
+    match (
+        expires,
+        sig.and_then(|sig| URL_SAFE_NO_PAD.decode(sig).ok()),
+    ) {
+        (Some(expires), Some(sig)) => {
+            (!check_expires || expires > unix_now())
+                && mac(secret, &stream, expires).verify_slice(&sig).is_ok()
+        }
+        _ => false,
+    }
+}
+
+/// Tenant of the `Authorization` header
+pub fn tenant<'a>(tenants: &'a [Tenant], headers: &HeaderMap) -> Option<&'a Tenant> {
+    let token = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))?;
+    tenants.iter().find(|t| t.key == token)
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs()
+}
+
 #[derive(Debug)]
 pub struct ManyValidate<ResBody> {
     header_values: HashSet<String>,
+    stream_tokens: Option<(StreamTokens, Permission)>,
+    tenants: Vec<Tenant>,
+    url_secret: String,
     _ty: PhantomData<fn() -> ResBody>,
 }
 
@@ -27,15 +202,69 @@ impl<ResBody> ManyValidate<ResBody> {
         }
         Self {
             header_values,
+            stream_tokens: None,
+            tenants: auth.tenants,
+            url_secret: auth.url_secret,
             _ty: PhantomData,
         }
     }
+
+    /// Also accept stream tokens with this permission for the stream in the path
+    pub fn with_stream_tokens(
+        mut self,
+        stream_tokens: StreamTokens,
+        permission: Permission,
+    ) -> Self {
+        self.stream_tokens = Some((stream_tokens, permission));
+        self
+    }
+
+    fn validate_stream_token(&self, authorization: &str, path: &str) -> bool {
+        match (
+            &self.stream_tokens,
+            authorization.strip_prefix("Bearer "),
+            path_stream(path),
+        ) {
+            (Some((stream_tokens, permission)), Some(token), Some(stream)) => {
+                stream_tokens.validate(token, &stream, *permission)
+            }
+            _ => false,
+        }
+    }
+
+    /// Tenant keys are only for streams, never the admin API
+    fn validate_tenant(&self, authorization: &str, path: &str) -> bool {
+        match (
+            &self.stream_tokens,
+            authorization.strip_prefix("Bearer "),
+            path_stream(path),
+        ) {
+            (Some(_), Some(key), Some(stream)) => self
+                .tenants
+                .iter()
+                .any(|t| t.key == key && stream.starts_with(&t.prefix)),
+            _ => false,
+        }
+    }
+
+    /// Signed URLs are only for playback
+    /// Expires is only checked on creating session, `POST /whep/:id`,
+    /// PATCH, DELETE and layer of the `Location` keep working after that
+    fn validate_signed_url<B>(&self, request: &Request<B>) -> bool {
+        let create = request.method() == Method::POST && !request.uri().path().ends_with("/layer");
+        !self.url_secret.is_empty()
+            && matches!(self.stream_tokens, Some((_, Permission::Subscribe)))
+            && verify_signed_url(&self.url_secret, request.uri(), create)
+    }
 }
 
 impl<ResBody> Clone for ManyValidate<ResBody> {
     fn clone(&self) -> Self {
         Self {
             header_values: self.header_values.clone(),
+            stream_tokens: self.stream_tokens.clone(),
+            tenants: self.tenants.clone(),
+            url_secret: self.url_secret.clone(),
             _ty: PhantomData,
         }
     }
@@ -51,13 +280,67 @@ where
         if self.header_values.is_empty() {
             return Ok(());
         }
-        match request.headers().get(header::AUTHORIZATION) {
-            Some(actual) if self.header_values.contains(actual.to_str().unwrap()) => Ok(()),
-            _ => {
-                let mut res = Response::new(ResBody::default());
-                *res.status_mut() = StatusCode::UNAUTHORIZED;
-                Err(res)
+        let authorized = match request
+            .headers()
+            .get(header::AUTHORIZATION)
+            .and_then(|actual| actual.to_str().ok())
+        {
+            Some(actual) => {
+                self.header_values.contains(actual)
+                    || self.validate_stream_token(actual, request.uri().path())
+                    || self.validate_tenant(actual, request.uri().path())
             }
+            None => false,
+        };
+        if authorized || self.validate_signed_url(request) {
+            Ok(())
+        } else {
+            let mut res = Response::new(ResBody::default());
+            *res.status_mut() = StatusCode::UNAUTHORIZED;
+            Err(res)
         }
     }
 }
+
+#[cfg(test)]
+mod test {
+    use crate::auth::{path_stream, sign_url, verify_signed_url, Permission, StreamTokens};
+
+    #[test]
+    fn test_stream_tokens() {
+        let tokens = StreamTokens::default();
+        let token = tokens.create("777".to_string(), Permission::Subscribe, 0);
+        assert!(tokens.validate(&token.token, "777", Permission::Subscribe));
+        assert!(!tokens.validate(&token.token, "777", Permission::Publish));
+        assert!(!tokens.validate(&token.token, "778", Permission::Subscribe));
+        assert_eq!(tokens.list().len(), 1);
+        assert!(tokens.remove(&token.token));
+        assert!(!tokens.validate(&token.token, "777", Permission::Subscribe));
+    }
+
+    #[test]
+    fn test_signed_url() {
+        let signed = sign_url("secret", "777", 60).url.parse().unwrap();
+        assert!(verify_signed_url("secret", &signed, true));
+        assert!(!verify_signed_url("other", &signed, true));
+        let other = signed.to_string().replace("/whep/777", "/whep/778");
+        assert!(!verify_signed_url("secret", &other.parse().unwrap(), true));
+        let expired = sign_url("secret", "777", 0).url.parse().unwrap();
+        assert!(!verify_signed_url("secret", &expired, true));
+        assert!(verify_signed_url("secret", &expired, false));
+        let encoded = sign_url("secret", "live 777", 60).url;
+        assert!(encoded.starts_with("/whep/live%20777?"));
+        assert!(verify_signed_url("secret", &encoded.parse().unwrap(), true));
+    }
+
+    #[test]
+    fn test_path_stream() {
+        assert_eq!(path_stream("/whip/777"), Some("777".to_string()));
+        assert_eq!(
+            path_stream("/whep/a%2D777/layer"),
+            Some("a-777".to_string())
+        );
+        assert_eq!(path_stream("/whep/%FF"), None);
+        assert_eq!(path_stream("/whep"), None);
+    }
+}
@@ -1,5 +1,15 @@
+use crate::auth::Permission;
+use base64::{engine::general_purpose::STANDARD, Engine};
+use hmac::{Hmac, Mac};
+use ipnet::IpNet;
 use serde::{Deserialize, Serialize};
-use std::{env, fs};
+use sha1::Sha1;
+use std::{
+    env, fs,
+    net::SocketAddr,
+    str::FromStr,
+    time::{SystemTime, UNIX_EPOCH},
+};
 use webrtc::{
     ice,
     ice_transport::{ice_credential_type::RTCIceCredentialType, ice_server::RTCIceServer},
@@ -7,25 +17,80 @@ use webrtc::{
 };
 
 #[derive(Debug, Default, Clone, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
 pub struct Config {
     #[serde(default = "default_listen")]
     pub listen: String,
+    /// Serve admin routes (metrics) on this address instead of `listen`
+    #[serde(default)]
+    pub admin_listen: String,
     #[serde(default = "default_ice_servers")]
     pub ice_servers: Vec<IceServer>,
     #[serde(default)]
     pub auth: Auth,
     #[serde(default = "default_log")]
     pub log: Log,
+    #[serde(default)]
+    pub http: Http,
+    #[serde(default)]
+    pub tls: Option<Tls>,
+    #[serde(default)]
+    pub acl: Vec<AclRule>,
+    #[serde(default)]
+    pub stream_name: StreamName,
 }
 #[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
 pub struct Auth {
     #[serde(default)]
     pub accounts: Vec<Account>,
     #[serde(default)]
     pub tokens: Vec<String>,
+    /// Secret of signed WHEP URLs, Empty is disabled
+    #[serde(default)]
+    pub url_secret: String,
+    #[serde(default)]
+    pub hook: Option<AuthHook>,
+    #[serde(default)]
+    pub tenants: Vec<Tenant>,
+}
+
+/// API key scoped to streams starting with `prefix`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Tenant {
+    pub key: String,
+    pub prefix: String,
+    /// 0 is unlimited
+    #[serde(default)]
+    pub max_streams: usize,
+    /// 0 is unlimited
+    #[serde(default)]
+    pub max_subscribers: usize,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct AuthHook {
+    pub url: String,
+    /// Seconds
+    #[serde(default = "default_auth_hook_timeout")]
+    pub timeout: u64,
+    /// Seconds, 0 is disabled
+    #[serde(default = "default_auth_hook_cache_ttl")]
+    pub cache_ttl: u64,
+}
+
+fn default_auth_hook_timeout() -> u64 {
+    5
+}
+
+fn default_auth_hook_cache_ttl() -> u64 {
+    60
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
 pub struct Account {
     #[serde(default)]
     pub username: String,
@@ -33,10 +98,87 @@ pub struct Account {
     pub password: String,
 }
 
+/// IP allow/deny list for streams with `prefix`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct AclRule {
+    #[serde(default)]
+    pub prefix: String,
+    /// None is both publish and subscribe
+    #[serde(default)]
+    pub permission: Option<Permission>,
+    #[serde(default)]
+    pub allow: Vec<IpNet>,
+    #[serde(default)]
+    pub deny: Vec<IpNet>,
+}
+
+/// Rules of publish stream names
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct StreamName {
+    /// Regex the name must match, Empty is any
+    #[serde(default)]
+    pub pattern: String,
+    /// 0 is unlimited
+    #[serde(default)]
+    pub max_length: usize,
+    #[serde(default)]
+    pub reserved_prefixes: Vec<String>,
+    /// `POST /whip` redirects to a generated stream name
+    #[serde(default)]
+    pub generate: bool,
+}
+
 #[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
 pub struct Log {
     #[serde(default = "default_log_level")]
     pub level: String,
+    /// Write logs to this file instead of stdout, Empty is stdout
+    #[serde(default)]
+    pub file: String,
+    /// Rotate the file larger than this size in bytes, 0 is never
+    #[serde(default = "default_log_max_size")]
+    pub max_size: u64,
+    /// Number of rotated files to keep
+    #[serde(default = "default_log_max_files")]
+    pub max_files: usize,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Http {
+    #[serde(default = "default_http_body_limit")]
+    pub body_limit: usize,
+}
+
+impl Default for Http {
+    fn default() -> Self {
+        Http {
+            body_limit: default_http_body_limit(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Tls {
+    pub cert: String,
+    pub key: String,
+    /// "1.2" or "1.3", Default: "1.2"
+    #[serde(default)]
+    pub min_version: String,
+    /// Empty is all rustls supported cipher suites
+    #[serde(default)]
+    pub cipher_suites: Vec<String>,
+    /// Plain HTTP listen address redirect to HTTPS, Empty is disabled
+    #[serde(default)]
+    pub redirect_listen: String,
+}
+
+fn default_http_body_limit() -> usize {
+    64 * 1024
 }
 
 fn default_listen() -> String {
@@ -49,15 +191,32 @@ fn default_ice_servers() -> Vec<IceServer> {
         username: "".to_string(),
         credential: "".to_string(),
         credential_type: "".to_string(),
+        secret: "".to_string(),
+        ttl: default_ice_server_ttl(),
     }]
 }
 
+fn default_ice_server_ttl() -> u64 {
+    86400
+}
+
 fn default_log() -> Log {
     Log {
         level: default_log_level(),
+        file: "".to_string(),
+        max_size: default_log_max_size(),
+        max_files: default_log_max_files(),
     }
 }
 
+fn default_log_max_size() -> u64 {
+    100 * 1024 * 1024
+}
+
+fn default_log_max_files() -> usize {
+    5
+}
+
 fn default_log_level() -> String {
     env::var("LOG_LEVEL").unwrap_or_else(|_|
         if cfg!(debug_assertions) {
@@ -69,6 +228,7 @@ fn default_log_level() -> String {
 }
 
 #[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
 pub struct IceServer {
     #[serde(default)]
     pub urls: Vec<String>,
@@ -78,10 +238,37 @@ pub struct IceServer {
     pub credential: String,
     #[serde(default)]
     pub credential_type: String,
+    /// TURN REST API shared secret, when set `credential` is minted per session
+    #[serde(default)]
+    pub secret: String,
+    /// Lifetime of minted credentials in seconds
+    #[serde(default = "default_ice_server_ttl")]
+    pub ttl: u64,
 }
 
 // from https://github.com/webrtc-rs/webrtc/blob/71157ba2153a891a8cfd819f3cf1441a7a0808d8/webrtc/src/ice_transport/ice_server.rs
 impl IceServer {
+    /// Reference: https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00
+    pub(crate) fn credentials(&self) -> (String, String) {
+        if self.secret.is_empty() {
+            return (self.username.clone(), self.credential.clone());
+        }
+        let expiry = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_secs()
+            + self.ttl;
+        let username = if self.username.is_empty() {
+            expiry.to_string()
+        } else {
+            format!("{}:{}", expiry, self.username)
+        };
+        let mut mac = Hmac::<Sha1>::new_from_slice(self.secret.as_bytes())
+            .expect("HMAC can take key of any size");
+        mac.update(username.as_bytes());
+        (username, STANDARD.encode(mac.finalize().into_bytes()))
+    }
+
     pub(crate) fn parse_url(&self, url_str: &str) -> webrtc::error::Result<ice::url::Url> {
         Ok(ice::url::Url::parse_url(url_str)?)
     }
@@ -99,15 +286,16 @@ impl IceServer {
             if url.scheme == ice::url::SchemeType::Turn || url.scheme == ice::url::SchemeType::Turns
             {
                 // https://www.w3.org/TR/webrtc/#set-the-configuration (step #11.3.2)
-                if self.username.is_empty() || self.credential.is_empty() {
+                let (username, credential) = self.credentials();
+                if username.is_empty() || credential.is_empty() {
                     return Err(Error::ErrNoTurnCredentials);
                 }
-                url.username = self.username.clone();
+                url.username = username;
 
                 match self.credential_type.as_str().into() {
                     RTCIceCredentialType::Password => {
                         // https://www.w3.org/TR/webrtc/#set-the-configuration (step #11.3.3)
-                        url.password = self.credential.clone();
+                        url.password = credential;
                     }
                     RTCIceCredentialType::Oauth => {
                         // https://www.w3.org/TR/webrtc/#set-the-configuration (step #11.3.4)
@@ -130,43 +318,265 @@ impl IceServer {
 
 impl From<IceServer> for RTCIceServer {
     fn from(val: IceServer) -> Self {
+        let (username, credential) = val.credentials();
         RTCIceServer {
             urls: val.urls,
-            username: val.username,
-            credential: val.credential,
+            username,
+            credential,
             credential_type: val.credential_type.as_str().into(),
         }
     }
 }
 
 impl Config {
-    pub(crate) fn parse() -> Self {
-        let mut result = fs::read_to_string("config.toml");
-        if result.is_err() {
-            result = fs::read_to_string("/etc/live777/config.toml");
-        }
-        if let Ok(cfg) = result {
-            let cfg: Self = toml::from_str(cfg.as_str()).expect("config parse error");
-            match cfg.validate() {
-                Ok(_) => cfg,
-                Err(err) => panic!("config validate [{}]", err),
+    /// Precedence: `overrides` > `LIVE777_*` env > config file > defaults
+    pub(crate) fn parse(path: Option<String>, overrides: &[String]) -> Self {
+        let result = match path {
+            Some(path) => Some(fs::read_to_string(path).expect("config read error")),
+            None => fs::read_to_string("config.toml")
+                .or_else(|_| fs::read_to_string("/etc/live777/config.toml"))
+                .ok(),
+        };
+        let mut table: toml::Table = match result {
+            Some(cfg) => toml::from_str(cfg.as_str()).expect("config parse error"),
+            None => toml::Table::new(),
+        };
+        // Keys that aren't UTF-8 can't be overrides, and must not stop startup
+        for (key, value) in env::vars_os() {
+            let key = match key.into_string() {
+                Ok(key) => key,
+                Err(_) => continue,
+            };
+            if let Some(key) = key.strip_prefix(ENV_PREFIX) {
+                let value = value
+                    .into_string()
+                    .unwrap_or_else(|_| panic!("config env {}{} is not UTF-8", ENV_PREFIX, key));
+                let key = key.to_lowercase().replace("__", ".");
+                Self::set_override(&mut table, &key, &value)
+                    .unwrap_or_else(|e| panic!("config env {}{} error [{}]", ENV_PREFIX, key, e));
             }
-        } else {
-            Config {
-                ice_servers: default_ice_servers(),
-                listen: default_listen(),
-                auth: Default::default(),
-                log: default_log(),
+        }
+        for kv in overrides {
+            let (key, value) = kv
+                .split_once('=')
+                .unwrap_or_else(|| panic!("config override {} must be KEY=VALUE", kv));
+            Self::set_override(&mut table, key, value)
+                .unwrap_or_else(|e| panic!("config override {} error [{}]", key, e));
+        }
+        let mut cfg: Self = toml::Value::Table(table)
+            .try_into()
+            .expect("config parse error");
+        match cfg.resolve_secrets().and_then(|_| cfg.validate()) {
+            Ok(_) => cfg,
+            Err(err) => panic!("config validate [{}]", err),
+        }
+    }
+
+    /// Set `value` parsed as TOML, unless only the string fits the config,
+    /// e.g. a numeric secret
+    fn set_override(table: &mut toml::Table, key: &str, value: &str) -> anyhow::Result<()> {
+        let fits = |t: &toml::Table| toml::Value::Table(t.clone()).try_into::<Self>().is_ok();
+        let mut parsed = table.clone();
+        set_value(&mut parsed, key, value, true)?;
+        if !fits(&parsed) {
+            let mut string = table.clone();
+            set_value(&mut string, key, value, false)?;
+            if fits(&string) {
+                parsed = string;
             }
         }
+        *table = parsed;
+        Ok(())
+    }
+
+    /// Replace `env:VAR` and `file:/path` references of secrets with their values
+    fn resolve_secrets(&mut self) -> anyhow::Result<()> {
+        for ice_server in self.ice_servers.iter_mut() {
+            ice_server.credential = resolve_secret(&ice_server.credential)?;
+            ice_server.secret = resolve_secret(&ice_server.secret)?;
+        }
+        for account in self.auth.accounts.iter_mut() {
+            account.password = resolve_secret(&account.password)?;
+        }
+        for token in self.auth.tokens.iter_mut() {
+            *token = resolve_secret(token)?;
+        }
+        for tenant in self.auth.tenants.iter_mut() {
+            tenant.key = resolve_secret(&tenant.key)?;
+        }
+        self.auth.url_secret = resolve_secret(&self.auth.url_secret)?;
+        Ok(())
+    }
+
+    /// Secrets are replaced by `******`
+    pub(crate) fn masked(&self) -> Self {
+        let mut cfg = self.clone();
+        for ice_server in cfg.ice_servers.iter_mut() {
+            ice_server.credential = mask(&ice_server.credential);
+            ice_server.secret = mask(&ice_server.secret);
+        }
+        for account in cfg.auth.accounts.iter_mut() {
+            account.password = mask(&account.password);
+        }
+        for token in cfg.auth.tokens.iter_mut() {
+            *token = mask(token);
+        }
+        for tenant in cfg.auth.tenants.iter_mut() {
+            tenant.key = mask(&tenant.key);
+        }
+        cfg.auth.url_secret = mask(&cfg.auth.url_secret);
+        cfg
     }
 
     fn validate(&self) -> anyhow::Result<()> {
+        SocketAddr::from_str(&self.listen)
+            .map_err(|e| anyhow::anyhow!(format!("listen error : {}", e)))?;
+        if !self.admin_listen.is_empty() {
+            SocketAddr::from_str(&self.admin_listen)
+                .map_err(|e| anyhow::anyhow!(format!("admin_listen error : {}", e)))?;
+        }
         for ice_server in self.ice_servers.iter() {
             ice_server
                 .validate()
                 .map_err(|e| anyhow::anyhow!(format!("ice_server error : {}", e)))?;
         }
+        if let Some(tls) = &self.tls {
+            crate::tls::validate(tls).map_err(|e| anyhow::anyhow!(format!("tls error : {}", e)))?;
+        }
+        let policy = crate::stream_name::Policy::new(&self.stream_name)
+            .map_err(|e| anyhow::anyhow!(format!("stream_name error : {}", e)))?;
+        if self.stream_name.generate && policy.generate().is_none() {
+            return Err(anyhow::anyhow!(
+                "stream_name error : generated names never pass the rules"
+            ));
+        }
+        // Without tokens or accounts the server is open, tenants and signed URLs are ignored
+        let open = self.auth.tokens.is_empty() && self.auth.accounts.is_empty();
+        if open && !self.auth.tenants.is_empty() {
+            return Err(anyhow::anyhow!(
+                "auth error : tenants require auth tokens or accounts"
+            ));
+        }
+        if open && !self.auth.url_secret.is_empty() {
+            return Err(anyhow::anyhow!(
+                "auth error : url_secret requires auth tokens or accounts"
+            ));
+        }
         Ok(())
     }
 }
+
+fn mask(secret: &str) -> String {
+    if secret.is_empty() {
+        "".to_string()
+    } else {
+        "******".to_string()
+    }
+}
+
+/// `LIVE777_AUTH__URL_SECRET` is `auth.url_secret`
+const ENV_PREFIX: &str = "LIVE777_";
+
+/// Set the dotted `key` to `value`, parsed as TOML if `parse` and it is valid TOML,
+/// otherwise as a string
+fn set_value(table: &mut toml::Table, key: &str, value: &str, parse: bool) -> anyhow::Result<()> {
+    let value = toml::from_str::<toml::Table>(&format!("v = {}", value))
+        .ok()
+        .filter(|_| parse)
+        .and_then(|mut t| t.remove("v"))
+        .unwrap_or_else(|| toml::Value::String(value.to_string()));
+    let mut keys: Vec<&str> = key.split('.').collect();
+    let last = keys.pop().unwrap_or_default();
+    let mut table = table;
+    for k in keys {
+        table = table
+            .entry(k)
+            .or_insert_with(|| toml::Value::Table(toml::Table::new()))
+            .as_table_mut()
+            .ok_or_else(|| anyhow::anyhow!(format!("{} is not a table", k)))?;
+    }
+    table.insert(last.to_string(), value);
+    Ok(())
+}
+
+fn resolve_secret(value: &str) -> anyhow::Result<String> {
+    if let Some(name) = value.strip_prefix("env:") {
+        env::var(name).map_err(|e| anyhow::anyhow!(format!("secret env {} error : {}", name, e)))
+    } else if let Some(path) = value.strip_prefix("file:") {
+        fs::read_to_string(path)
+            .map(|secret| secret.trim_end_matches(['\r', '\n']).to_string())
+            .map_err(|e| anyhow::anyhow!(format!("secret file {} error : {}", path, e)))
+    } else if value.starts_with("vault:") {
+        Err(anyhow::anyhow!(format!(
+            "secret {} error : vault is unsupported",
+            value
+        )))
+    } else {
+        Ok(value.to_string())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use crate::config::{resolve_secret, set_value, Config, IceServer};
+
+    #[test]
+    fn test_set_value() {
+        let mut table: toml::Table = toml::from_str("listen = \"[::]:7777\"").unwrap();
+        set_value(&mut table, "listen", "0.0.0.0:8888", true).unwrap();
+        set_value(&mut table, "auth.tokens", "[\"live777\"]", true).unwrap();
+        set_value(&mut table, "http.body_limit", "1024", true).unwrap();
+        set_value(&mut table, "auth.url_secret", "123456", false).unwrap();
+        assert_eq!(table["listen"].as_str(), Some("0.0.0.0:8888"));
+        assert_eq!(table["auth"]["tokens"][0].as_str(), Some("live777"));
+        assert_eq!(table["http"]["body_limit"].as_integer(), Some(1024));
+        assert_eq!(table["auth"]["url_secret"].as_str(), Some("123456"));
+        assert!(set_value(&mut table, "listen.port", "7777", true).is_err());
+    }
+
+    #[test]
+    fn test_set_override() {
+        let mut table = toml::Table::new();
+        Config::set_override(&mut table, "http.body_limit", "1024").unwrap();
+        Config::set_override(&mut table, "auth.url_secret", "123456").unwrap();
+        Config::set_override(&mut table, "auth.tokens", "[\"live777\"]").unwrap();
+        let cfg: Config = toml::Value::Table(table).try_into().unwrap();
+        assert_eq!(cfg.http.body_limit, 1024);
+        assert_eq!(cfg.auth.url_secret, "123456");
+        assert_eq!(cfg.auth.tokens, vec!["live777".to_string()]);
+    }
+
+    #[test]
+    fn test_resolve_secret() {
+        std::env::set_var("TEST_LIVE777_SECRET", "live777");
+        assert_eq!(resolve_secret("live777").unwrap(), "live777");
+        assert_eq!(
+            resolve_secret("env:TEST_LIVE777_SECRET").unwrap(),
+            "live777"
+        );
+        assert!(resolve_secret("env:TEST_LIVE777_SECRET_NOT_EXISTS").is_err());
+        assert!(resolve_secret("file:/not/exists").is_err());
+        assert!(resolve_secret("vault:secret/live777#token").is_err());
+    }
+
+    #[test]
+    fn test_ice_server_credentials() {
+        let mut server = IceServer {
+            urls: vec!["turn:turn.example.com".to_string()],
+            username: "live777".to_string(),
+            credential: "static".to_string(),
+            credential_type: "password".to_string(),
+            secret: "".to_string(),
+            ttl: 3600,
+        };
+        assert_eq!(
+            server.credentials(),
+            ("live777".to_string(), "static".to_string())
+        );
+        server.secret = "secret".to_string();
+        let (username, credential) = server.credentials();
+        assert!(username.ends_with(":live777"));
+        assert_ne!(credential, "static");
+        assert!(server.validate().is_ok());
+    }
+}
@@ -1,7 +1,43 @@
 use serde::Deserialize;
 
+use crate::auth::Permission;
+
 #[derive(Deserialize)]
 pub struct SelectLayer {
     #[serde(rename = "encodingId")]
     pub encoding_id: Option<String>,
 }
+
+#[derive(Deserialize)]
+pub struct QueryInfo {
+    #[serde(default)]
+    pub prefix: String,
+    #[serde(default)]
+    pub offset: usize,
+    pub limit: Option<usize>,
+}
+
+#[derive(Deserialize)]
+pub struct CreateStreamToken {
+    pub stream: String,
+    pub permission: Permission,
+    /// Seconds, 0 is never expires
+    #[serde(default)]
+    pub ttl: u64,
+}
+
+#[derive(Deserialize)]
+pub struct SignUrl {
+    pub stream: String,
+    /// Seconds
+    pub ttl: u64,
+}
+
+#[derive(Deserialize)]
+pub struct QueryEvents {
+    /// Event `id`, only later events are returned
+    #[serde(default)]
+    pub since: u64,
+    #[serde(rename = "type")]
+    pub kind: Option<String>,
+}
@@ -0,0 +1,137 @@
+use std::collections::VecDeque;
+use std::sync::Mutex;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use lazy_static::lazy_static;
+use serde::Serialize;
+use tokio::sync::broadcast;
+
+lazy_static! {
+    static ref EVENTS: broadcast::Sender<Event> = broadcast::channel(1024).0;
+    static ref HISTORY: Mutex<VecDeque<Event>> = Mutex::new(VecDeque::new());
+}
+
+/// Latest events kept for the history API
+const HISTORY_SIZE: usize = 1024;
+
+#[derive(Serialize, Clone, Debug)]
+pub struct Event {
+    /// Increases by one per event, poll the history with the last seen `since`
+    pub id: u64,
+    /// Unix timestamp in milliseconds
+    pub timestamp: u64,
+    #[serde(flatten)]
+    pub kind: EventKind,
+}
+
+#[derive(Serialize, Clone, Debug)]
+#[serde(tag = "type", rename_all = "camelCase")]
+pub enum EventKind {
+    StreamUp { stream: String },
+    StreamDown { stream: String },
+    PublishUp { stream: String, session: String },
+    PublishDown { stream: String, session: String },
+    SubscribeUp { stream: String, session: String },
+    SubscribeDown { stream: String, session: String },
+}
+
+impl EventKind {
+    /// The same as the serialized `type`
+    pub fn name(&self) -> &'static str {
+        match self {
+            EventKind::StreamUp { .. } => "streamUp",
+            EventKind::StreamDown { .. } => "streamDown",
+            EventKind::PublishUp { .. } => "publishUp",
+            EventKind::PublishDown { .. } => "publishDown",
+            EventKind::SubscribeUp { .. } => "subscribeUp",
+            EventKind::SubscribeDown { .. } => "subscribeDown",
+        }
+    }
+}
+
+pub fn emit(kind: EventKind) {
+    let timestamp = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_millis() as u64;
+    let event = {
+        let mut history = HISTORY.lock().unwrap();
+        let id = history.back().map_or(1, |event| event.id + 1);
+        let event = Event {
+            id,
+            timestamp,
+            kind,
+        };
+        if history.len() == HISTORY_SIZE {
+            history.pop_front();
+        }
+        history.push_back(event.clone());
+        event
+    };
+    // No receivers is not an error
+    let _ = EVENTS.send(event);
+}
+
+/// Events with `id` after `since`, oldest first
+pub fn history(since: u64, kind: Option<&str>) -> Vec<Event> {
+    HISTORY
+        .lock()
+        .unwrap()
+        .iter()
+        .filter(|event| event.id > since)
+        .filter(|event| kind.map_or(true, |kind| event.kind.name() == kind))
+        .cloned()
+        .collect()
+}
+
+pub fn subscribe() -> broadcast::Receiver<Event> {
+    EVENTS.subscribe()
+}
+
+#[cfg(test)]
+mod test {
+    use crate::event::{emit, history, EventKind, HISTORY_SIZE};
+
+    fn streams(since: u64, kind: Option<&str>) -> Vec<String> {
+        history(since, kind)
+            .into_iter()
+            .map(|event| match event.kind {
+                EventKind::StreamUp { stream }
+                | EventKind::StreamDown { stream }
+                | EventKind::PublishUp { stream, .. }
+                | EventKind::PublishDown { stream, .. }
+                | EventKind::SubscribeUp { stream, .. }
+                | EventKind::SubscribeDown { stream, .. } => stream,
+            })
+            .collect()
+    }
+
+    // One test, the history is global
+    #[test]
+    fn test_history() {
+        emit(EventKind::StreamUp {
+            stream: "before".to_string(),
+        });
+        let since = history(0, None).last().unwrap().id;
+        emit(EventKind::StreamUp {
+            stream: "after".to_string(),
+        });
+        emit(EventKind::PublishUp {
+            stream: "after".to_string(),
+            session: "session".to_string(),
+        });
+        assert!(streams(0, None).contains(&"before".to_string()));
+        assert_eq!(streams(since, None), vec!["after", "after"]);
+        assert_eq!(streams(since, Some("publishUp")), vec!["after"]);
+        assert!(streams(since, Some("streamDown")).is_empty());
+
+        for _ in 0..HISTORY_SIZE {
+            emit(EventKind::StreamDown {
+                stream: "evict".to_string(),
+            });
+        }
+        let streams = streams(0, None);
+        assert_eq!(streams.len(), HISTORY_SIZE);
+        assert!(streams.iter().all(|stream| stream == "evict"));
+    }
+}
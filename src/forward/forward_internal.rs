@@ -5,12 +5,11 @@ use std::sync::{Arc, Weak};
 use anyhow::Result;
 use log::{debug, info, warn};
 use tokio::sync::mpsc::{channel, unbounded_channel, Receiver, Sender, UnboundedSender};
-use tokio::sync::RwLock;
+use tokio::sync::{Notify, RwLock};
 use webrtc::api::interceptor_registry::register_default_interceptors;
 use webrtc::api::media_engine::MediaEngine;
 use webrtc::api::APIBuilder;
 use webrtc::ice_transport::ice_candidate::RTCIceCandidateInit;
-use webrtc::ice_transport::ice_server::RTCIceServer;
 use webrtc::interceptor::registry::Registry;
 use webrtc::peer_connection::configuration::RTCConfiguration;
 use webrtc::peer_connection::peer_connection_state::RTCPeerConnectionState;
@@ -28,7 +27,9 @@ use webrtc::track::track_local::track_local_static_rtp::TrackLocalStaticRTP;
 use webrtc::track::track_local::{TrackLocal, TrackLocalWriter};
 use webrtc::track::track_remote::TrackRemote;
 
-use crate::forward::info::Layer;
+use crate::config::IceServer;
+use crate::event::{self, EventKind};
+use crate::forward::info::{ForwardInfo, Layer, SessionInfo};
 use crate::AppError;
 use crate::{media, metrics};
 
@@ -49,6 +50,13 @@ impl PeerWrap {
     fn get_key(&self) -> &str {
         self.0.get_stats_id()
     }
+
+    fn info(&self) -> SessionInfo {
+        SessionInfo {
+            id: self.get_key().to_string(),
+            connect_state: self.0.connection_state().to_string(),
+        }
+    }
 }
 
 impl Clone for PeerWrap {
@@ -112,20 +120,37 @@ pub(crate) struct PeerForwardInternal {
     anchor: RwLock<Option<Arc<RTCPeerConnection>>>,
     subscribe_group: RwLock<Vec<PeerWrap>>,
     anchor_track_forward_map: Arc<RwLock<HashMap<TrackRemoteWrap, TrackForward>>>,
-    ice_server: Vec<RTCIceServer>,
+    ice_server: Vec<IceServer>,
+    anchor_down: Notify,
 }
 
 impl PeerForwardInternal {
-    pub(crate) fn new(id: impl ToString, ice_server: Vec<RTCIceServer>) -> Self {
+    pub(crate) fn new(id: impl ToString, ice_server: Vec<IceServer>) -> Self {
         PeerForwardInternal {
             id: id.to_string(),
             anchor: Default::default(),
             subscribe_group: Default::default(),
             anchor_track_forward_map: Default::default(),
             ice_server,
+            anchor_down: Notify::new(),
         }
     }
 
+    pub(crate) async fn info(&self) -> ForwardInfo {
+        let anchor = self.anchor.read().await.as_ref().cloned();
+        let subscribe_group = self.subscribe_group.read().await;
+        ForwardInfo {
+            id: self.id.clone(),
+            publish_session: anchor.map(|anchor| PeerWrap(anchor).info()),
+            subscribe_sessions: subscribe_group.iter().map(|p| p.info()).collect(),
+        }
+    }
+
+    /// Returns once the anchor is removed
+    pub(crate) async fn wait_anchor_down(&self) {
+        self.anchor_down.notified().await
+    }
+
     pub(crate) async fn anchor_is_some(&self) -> bool {
         let anchor = self.anchor.read().await;
         anchor.is_some()
@@ -159,6 +184,10 @@ impl PeerForwardInternal {
             .into());
         }
         info!("[{}] [anchor] set {}", self.id, peer.get_stats_id());
+        event::emit(EventKind::PublishUp {
+            stream: self.id.clone(),
+            session: peer.get_stats_id().to_string(),
+        });
         *anchor = Some(peer);
         metrics::PUBLISH.inc();
         Ok(())
@@ -178,10 +207,23 @@ impl PeerForwardInternal {
         for peer_wrap in subscribe_group.iter() {
             let _ = peer_wrap.0.close().await;
         }
-        subscribe_group.clear();
+        // Cleared here, remove_subscribe of these peers finds nothing
+        for peer_wrap in subscribe_group.drain(..) {
+            info!("[{}] [subscribe] [{}] down", self.id, peer_wrap.get_key());
+            event::emit(EventKind::SubscribeDown {
+                stream: self.id.clone(),
+                session: peer_wrap.get_key().to_string(),
+            });
+            metrics::SUBSCRIBE.dec();
+        }
         *anchor = None;
         info!("[{}] [anchor] set none", self.id);
+        event::emit(EventKind::PublishDown {
+            stream: self.id.clone(),
+            session: peer.get_stats_id().to_string(),
+        });
         metrics::PUBLISH.dec();
+        self.anchor_down.notify_one();
         Ok(())
     }
 
@@ -189,6 +231,10 @@ impl PeerForwardInternal {
         let mut subscribe_peers = self.subscribe_group.write().await;
         subscribe_peers.push(PeerWrap(peer.clone()));
         info!("[{}] [subscribe] [{}] up", self.id, peer.get_stats_id());
+        event::emit(EventKind::SubscribeUp {
+            stream: self.id.clone(),
+            session: peer.get_stats_id().to_string(),
+        });
         metrics::SUBSCRIBE.inc();
         Ok(())
     }
@@ -304,6 +350,10 @@ impl PeerForwardInternal {
         subscribe_peers.retain(|x| x != &peer_wrap);
         if size != subscribe_peers.len() {
             info!("[{}] [subscribe] [{}] down", self.id, peer.get_stats_id());
+            event::emit(EventKind::SubscribeDown {
+                stream: self.id.clone(),
+                session: peer.get_stats_id().to_string(),
+            });
             metrics::SUBSCRIBE.dec();
         }
         Ok(())
@@ -336,7 +386,7 @@ impl PeerForwardInternal {
             .with_interceptor_registry(registry)
             .build();
         let config = RTCConfiguration {
-            ice_servers: self.ice_server.clone(),
+            ice_servers: self.ice_server.iter().cloned().map(|i| i.into()).collect(),
             ..Default::default()
         };
         let peer = Arc::new(api.new_peer_connection(config).await?);
@@ -367,7 +417,7 @@ impl PeerForwardInternal {
             .with_interceptor_registry(registry)
             .build();
         let config = RTCConfiguration {
-            ice_servers: self.ice_server.clone(),
+            ice_servers: self.ice_server.iter().cloned().map(|i| i.into()).collect(),
             ..Default::default()
         };
         let peer = Arc::new(api.new_peer_connection(config).await?);
@@ -502,6 +552,18 @@ impl PeerForwardInternal {
         Ok(())
     }
 
+    pub(crate) async fn close(&self) -> Result<()> {
+        let anchor = self.anchor.read().await.as_ref().cloned();
+        let subscribe_group = self.subscribe_group.read().await.clone();
+        for peer in subscribe_group {
+            let _ = peer.0.close().await;
+        }
+        if let Some(anchor) = anchor {
+            let _ = anchor.close().await;
+        }
+        Ok(())
+    }
+
     pub(crate) async fn remove_peer(&self, key: String) -> Result<bool> {
         let anchor = self.anchor.read().await;
         if let Some(anchor) = anchor.as_ref() {
@@ -515,10 +577,10 @@ impl PeerForwardInternal {
         for peer in peers.iter() {
             if peer.get_key() == key {
                 peer.0.close().await?;
-                break;
+                return Ok(false);
             }
         }
-        Ok(false)
+        Err(AppError::ResourceNotFound(format!("session {} not exists", key)).into())
     }
 
     pub(crate) async fn anchor_track_up(
@@ -5,3 +5,19 @@ pub struct Layer {
     #[serde(rename = "encodingId")]
     pub encoding_id: String,
 }
+
+#[derive(Serialize, Deserialize, Clone)]
+pub struct SessionInfo {
+    pub id: String,
+    #[serde(rename = "connectState")]
+    pub connect_state: String,
+}
+
+#[derive(Serialize, Deserialize, Clone)]
+pub struct ForwardInfo {
+    pub id: String,
+    #[serde(rename = "publishSession")]
+    pub publish_session: Option<SessionInfo>,
+    #[serde(rename = "subscribeSessions")]
+    pub subscribe_sessions: Vec<SessionInfo>,
+}
@@ -5,15 +5,15 @@ use anyhow::{Ok, Result};
 use log::info;
 use tokio::sync::Mutex;
 use webrtc::ice_transport::ice_candidate::RTCIceCandidateInit;
-use webrtc::ice_transport::ice_server::RTCIceServer;
 use webrtc::peer_connection::peer_connection_state::RTCPeerConnectionState;
 use webrtc::peer_connection::sdp::session_description::RTCSessionDescription;
 use webrtc::peer_connection::RTCPeerConnection;
 use webrtc::rtp_transceiver::rtp_codec::RTPCodecType;
 use webrtc::sdp::{MediaDescription, SessionDescription};
 
+use crate::config::IceServer;
 use crate::forward::forward_internal::{get_peer_key, PeerForwardInternal};
-use crate::forward::info::Layer;
+use crate::forward::info::{ForwardInfo, Layer};
 use crate::media;
 use crate::AppError;
 
@@ -29,7 +29,7 @@ pub struct PeerForward {
 }
 
 impl PeerForward {
-    pub fn new(id: impl ToString, ice_server: Vec<RTCIceServer>) -> Self {
+    pub fn new(id: impl ToString, ice_server: Vec<IceServer>) -> Self {
         PeerForward {
             anchor_lock: Arc::new(Mutex::new(())),
             internal: Arc::new(PeerForwardInternal::new(id, ice_server)),
@@ -151,6 +151,24 @@ impl PeerForward {
         self.internal.remove_peer(key).await
     }
 
+    pub async fn close(&self) -> Result<()> {
+        self.internal.close().await
+    }
+
+    /// Returns once the publisher is gone, closed by itself or removed
+    pub async fn wait_anchor_down(&self) {
+        self.internal.wait_anchor_down().await
+    }
+
+    /// Clones of the same forward, not just the same stream name
+    pub fn same(&self, other: &PeerForward) -> bool {
+        Arc::ptr_eq(&self.internal, &other.internal)
+    }
+
+    pub async fn info(&self) -> ForwardInfo {
+        self.internal.info().await
+    }
+
     pub async fn layers(&self) -> Result<Vec<Layer>> {
         if self.internal.publish_is_svc().await {
             let mut layers = vec![];
@@ -0,0 +1,88 @@
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::time::{Duration, Instant};
+
+use http::HeaderMap;
+use log::warn;
+use serde::Serialize;
+use tokio::sync::Mutex;
+
+use crate::auth::Permission;
+use crate::config;
+
+#[derive(Serialize)]
+struct HookRequest<'a> {
+    stream: &'a str,
+    permission: Permission,
+    #[serde(rename = "clientIp")]
+    client_ip: IpAddr,
+    headers: HashMap<&'a str, &'a str>,
+}
+
+/// Everything sent to the hook, the headers sorted
+type CacheKey = (String, Permission, IpAddr, Vec<(String, String)>);
+
+/// External authorization, a 2xx response of `url` allows the request
+pub struct AuthHook {
+    url: String,
+    client: reqwest::Client,
+    cache_ttl: Duration,
+    cache: Mutex<HashMap<CacheKey, (Instant, bool)>>,
+}
+
+impl AuthHook {
+    pub fn new(cfg: config::AuthHook) -> Self {
+        AuthHook {
+            url: cfg.url,
+            client: reqwest::Client::builder()
+                .timeout(Duration::from_secs(cfg.timeout))
+                .build()
+                .expect("auth hook http client"),
+            cache_ttl: Duration::from_secs(cfg.cache_ttl),
+            cache: Default::default(),
+        }
+    }
+
+    pub async fn allow(
+        &self,
+        stream: &str,
+        permission: Permission,
+        client_ip: IpAddr,
+        headers: &HeaderMap,
+    ) -> bool {
+        let headers: HashMap<&str, &str> = headers
+            .iter()
+            .filter_map(|(k, v)| v.to_str().ok().map(|v| (k.as_str(), v)))
+            .collect();
+        let mut cache_headers: Vec<(String, String)> = headers
+            .iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect();
+        cache_headers.sort();
+        let key = (stream.to_string(), permission, client_ip, cache_headers);
+        if let Some((time, allow)) = self.cache.lock().await.get(&key) {
+            if time.elapsed() < self.cache_ttl {
+                return *allow;
+            }
+        }
+        let req = HookRequest {
+            stream,
+            permission,
+            client_ip,
+            headers,
+        };
+        let allow = match self.client.post(&self.url).json(&req).send().await {
+            Ok(res) => res.status().is_success(),
+            Err(e) => {
+                warn!("auth hook error: {}", e);
+                return false;
+            }
+        };
+        if !self.cache_ttl.is_zero() {
+            let mut cache = self.cache.lock().await;
+            cache.retain(|_, (time, _)| time.elapsed() < self.cache_ttl);
+            cache.insert(key, (Instant::now(), allow));
+        }
+        allow
+    }
+}
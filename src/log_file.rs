@@ -0,0 +1,84 @@
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+
+/// Log file rotated by size: `{path}` -> `{path}.1` -> ... -> `{path}.{max_files}`
+pub struct RotatingFile {
+    path: String,
+    max_size: u64,
+    max_files: usize,
+    file: File,
+    size: u64,
+}
+
+impl RotatingFile {
+    pub fn new(path: String, max_size: u64, max_files: usize) -> io::Result<Self> {
+        let file = OpenOptions::new().create(true).append(true).open(&path)?;
+        let size = file.metadata()?.len();
+        Ok(Self {
+            path,
+            max_size,
+            max_files,
+            file,
+            size,
+        })
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        self.file.flush()?;
+        if self.max_files == 0 {
+            self.file.set_len(0)?;
+        } else {
+            for i in (1..self.max_files).rev() {
+                let from = format!("{}.{}", self.path, i);
+                if fs::metadata(&from).is_ok() {
+                    fs::rename(&from, format!("{}.{}", self.path, i + 1))?;
+                }
+            }
+            fs::rename(&self.path, format!("{}.1", self.path))?;
+            self.file = OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(&self.path)?;
+        }
+        self.size = 0;
+        Ok(())
+    }
+}
+
+impl Write for RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if self.max_size != 0 && self.size > 0 && self.size + buf.len() as u64 > self.max_size {
+            self.rotate()?;
+        }
+        let n = self.file.write(buf)?;
+        self.size += n as u64;
+        Ok(n)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::fs;
+    use std::io::Write;
+
+    use crate::log_file::RotatingFile;
+
+    #[test]
+    fn test_rotating_file() {
+        let dir = std::env::temp_dir().join(format!("live777-log-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("live777.log").to_string_lossy().to_string();
+        let mut file = RotatingFile::new(path.clone(), 8, 2).unwrap();
+        for _ in 0..4 {
+            file.write_all(b"live777\n").unwrap();
+        }
+        assert_eq!(fs::read_to_string(&path).unwrap(), "live777\n");
+        assert!(fs::metadata(format!("{}.2", path)).is_ok());
+        assert!(fs::metadata(format!("{}.3", path)).is_err());
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -1,9 +1,14 @@
-use std::net::SocketAddr;
+use std::collections::HashMap;
+use std::convert::Infallible;
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr};
 use std::str::FromStr;
 use std::sync::Arc;
+use std::time::Duration;
 
+use axum::extract::{ConnectInfo, DefaultBodyLimit, Query};
 use axum::http::{HeaderMap, Uri};
-use axum::routing::get;
+use axum::response::sse::{Event as SseEvent, KeepAlive, Sse};
+use axum::routing::{delete, get};
 use axum::Json;
 use axum::{
     extract::{Path, State},
@@ -12,10 +17,14 @@ use axum::{
     routing::post,
     Router,
 };
-use forward::info::Layer;
+use clap::{Parser, Subcommand};
+use forward::info::{ForwardInfo, Layer};
 use http::header::ToStrError;
 use log::{info, debug, error};
 use thiserror::Error;
+use tokio::sync::Mutex;
+use tokio_stream::wrappers::BroadcastStream;
+use tokio_stream::{Stream, StreamExt};
 #[cfg(debug_assertions)]
 use tower_http::services::{ServeDir, ServeFile};
 use tower_http::validate_request::ValidateRequestHeaderLayer;
@@ -26,21 +35,55 @@ use path::manager::Manager;
 #[cfg(not(debug_assertions))]
 use {http::header, rust_embed::RustEmbed};
 
-use crate::auth::ManyValidate;
-use crate::config::Config;
-use crate::dto::req::SelectLayer;
+use crate::auth::{ManyValidate, Permission, SignedUrl, StreamToken, StreamTokens};
+use crate::config::{Config, Tls};
+use crate::dto::req::{CreateStreamToken, QueryEvents, QueryInfo, SelectLayer, SignUrl};
+use crate::hook::AuthHook;
 
+mod acl;
 mod auth;
 mod config;
 mod dto;
+mod event;
 mod forward;
+mod hook;
+mod log_file;
 mod media;
 mod metrics;
 mod path;
 mod signal;
+mod stream_name;
+mod systemd;
+mod tls;
+
+#[derive(Parser)]
+#[command(author, version, about, long_about = None)]
+struct Args {
+    /// Config file, Default: config.toml, /etc/live777/config.toml
+    #[arg(short, long)]
+    config: Option<String>,
+    /// Override config, higher than `LIVE777_*` env. e.g.: --set auth.url_secret=live777
+    #[arg(short, long, value_name = "KEY=VALUE")]
+    set: Vec<String>,
+    /// Validate config and exit
+    #[arg(long)]
+    check: bool,
+    /// Print the effective config with secrets masked and exit
+    #[arg(long)]
+    print_config: bool,
+    #[command(subcommand)]
+    command: Option<Command>,
+}
+
+#[derive(Subcommand)]
+enum Command {
+    /// Request `/readyz` of the local server, exit non-zero on failure
+    Healthcheck,
+}
 
 #[tokio::main]
 async fn main() {
+    let args = Args::parse();
     metrics::REGISTRY
         .register(Box::new(metrics::PUBLISH.clone()))
         .unwrap();
@@ -48,33 +91,82 @@ async fn main() {
         .register(Box::new(metrics::SUBSCRIBE.clone()))
         .unwrap();
 
-    let cfg = Config::parse();
-    env_logger::builder()
+    let cfg = Config::parse(args.config, &args.set);
+    if args.print_config {
+        print!(
+            "{}",
+            toml::to_string(&cfg.masked()).expect("config serialize error")
+        );
+        return;
+    }
+    if args.check {
+        if let Some(tls) = &cfg.tls {
+            tls::rustls_config(tls).expect("tls config error");
+        }
+        println!("config ok");
+        return;
+    }
+    if let Some(Command::Healthcheck) = args.command {
+        if let Err(e) = healthcheck(&cfg).await {
+            eprintln!("Healthcheck error: {e}");
+            std::process::exit(1);
+        }
+        return;
+    }
+    let mut logger = env_logger::builder();
+    logger
         .parse_filters(cfg.log.level.as_str())
-        .filter_module("webrtc", log::LevelFilter::Error)
-        .write_style(env_logger::WriteStyle::Auto)
-        .target(env_logger::Target::Stdout)
-        .init();
+        .filter_module("webrtc", log::LevelFilter::Error);
+    if cfg.log.file.is_empty() {
+        logger
+            .write_style(env_logger::WriteStyle::Auto)
+            .target(env_logger::Target::Stdout);
+    } else {
+        let file =
+            log_file::RotatingFile::new(cfg.log.file.clone(), cfg.log.max_size, cfg.log.max_files)
+                .expect("open log file error");
+        logger
+            .write_style(env_logger::WriteStyle::Never)
+            .target(env_logger::Target::Pipe(Box::new(file)));
+    }
+    logger.init();
     let addr = SocketAddr::from_str(&cfg.listen).expect("invalid listen address");
     info!("Server listening on {}", addr);
-    let ice_servers = cfg
-        .ice_servers
-        .clone()
-        .into_iter()
-        .map(|i| i.into())
-        .collect();
     let app_state = AppState {
-        paths: Arc::new(Manager::new(ice_servers)),
+        paths: Arc::new(Manager::new(cfg.ice_servers.clone())),
         config: cfg.clone(),
+        stream_tokens: Default::default(),
+        auth_hook: cfg
+            .auth
+            .hook
+            .clone()
+            .map(|hook| Arc::new(AuthHook::new(hook))),
+        stream_name: stream_name::Policy::new(&cfg.stream_name)
+            .expect("invalid stream_name config"),
+        tenant_quotas: Arc::new(
+            cfg.auth
+                .tenants
+                .iter()
+                .map(|t| (t.key.clone(), Mutex::new(())))
+                .collect(),
+        ),
     };
-    let auth_layer = ValidateRequestHeaderLayer::custom(ManyValidate::new(cfg.auth));
+    let auth_layer = ValidateRequestHeaderLayer::custom(ManyValidate::new(cfg.auth.clone()));
+    let publish_auth_layer = ValidateRequestHeaderLayer::custom(
+        ManyValidate::new(cfg.auth.clone())
+            .with_stream_tokens(app_state.stream_tokens.clone(), Permission::Publish),
+    );
+    let subscribe_auth_layer = ValidateRequestHeaderLayer::custom(
+        ManyValidate::new(cfg.auth)
+            .with_stream_tokens(app_state.stream_tokens.clone(), Permission::Subscribe),
+    );
     let mut app = Router::new()
         .route(
             "/whip/:id",
             post(whip)
                 .patch(add_ice_candidate)
                 .delete(remove_path_key)
-                .layer(auth_layer.clone())
+                .layer(publish_auth_layer.clone())
                 .options(ice_server_config),
         )
         .route(
@@ -82,23 +174,143 @@ async fn main() {
             post(whep)
                 .patch(add_ice_candidate)
                 .delete(remove_path_key)
-                .layer(auth_layer.clone())
+                .layer(subscribe_auth_layer.clone())
                 .options(ice_server_config),
         )
         .route(
             "/whep/:id/layer",
-            get(get_layer).post(select_layer).layer(auth_layer),
+            get(get_layer)
+                .post(select_layer)
+                .layer(subscribe_auth_layer),
         )
-        .route("/metrics", get(metrics))
-        .with_state(app_state);
-    app = static_server(app);
-    tokio::select!{
-        Err(e) = axum::Server::bind(&addr).serve(app.into_make_service()) => error!("Application error: {e}"),
-        msg = signal::wait_for_stop_signal() => debug!("Received signal: {}", msg),
+        .route("/healthz", get(health))
+        .route("/readyz", get(health));
+    if cfg.stream_name.generate {
+        app = app.route("/whip", post(whip_generate).layer(publish_auth_layer));
+    }
+    let api = Router::new()
+        .route("/streams", get(streams))
+        .route("/streams/:stream", delete(delete_stream))
+        .route("/streams/:stream/sessions/:session", delete(delete_session))
+        .route("/events", get(events))
+        .route("/events/history", get(events_history))
+        .route("/tokens", get(list_stream_tokens).post(create_stream_token))
+        .route("/tokens/:token", delete(delete_stream_token))
+        .route("/sign", post(sign_url))
+        .route("/config", get(show_config))
+        .layer(auth_layer);
+    let admin = Router::new()
+        .nest("/api/v1", api)
+        .route("/metrics", get(metrics));
+    if cfg.admin_listen.is_empty() {
+        app = app.merge(admin);
+    } else {
+        let admin_addr =
+            SocketAddr::from_str(&cfg.admin_listen).expect("invalid admin listen address");
+        // The streams dashboard calls `/api/v1` on its own origin
+        let admin = static_server(
+            admin
+                .layer(DefaultBodyLimit::max(cfg.http.body_limit))
+                .with_state(app_state.clone()),
+        );
+        // Bind before spawning, a taken port fails startup instead of the task
+        let admin_server = axum::Server::try_bind(&admin_addr)
+            .unwrap_or_else(|e| panic!("admin listen {} error [{}]", admin_addr, e));
+        info!("Admin listening on {}", admin_addr);
+        tokio::spawn(async move {
+            if let Err(e) = admin_server.serve(admin.into_make_service()).await {
+                error!("Admin error: {e}");
+            }
+        });
     }
+    let app = static_server(
+        app.layer(DefaultBodyLimit::max(cfg.http.body_limit))
+            .with_state(app_state),
+    );
+    let server = serve(addr, cfg.tls, app);
+    let stop = signal::wait_for_stop_signal();
+    tokio::pin!(server, stop);
+    // Fed here, a stuck main loop misses the watchdog
+    let mut watchdog = systemd::watchdog_interval().map(tokio::time::interval);
+    loop {
+        tokio::select! {
+            res = &mut server => {
+                if let Err(e) = res {
+                    error!("Application error: {e}");
+                }
+                break;
+            }
+            msg = &mut stop => {
+                debug!("Received signal: {}", msg);
+                break;
+            }
+            _ = async { watchdog.as_mut().unwrap().tick().await }, if watchdog.is_some() => {
+                systemd::notify("WATCHDOG=1");
+            }
+        }
+    }
+    systemd::notify("STOPPING=1");
     info!("Server shutdown");
 }
 
+async fn serve(addr: SocketAddr, tls: Option<Tls>, app: Router) -> anyhow::Result<()> {
+    match tls {
+        Some(tls) => {
+            let config = tls::rustls_config(&tls)?;
+            if !tls.redirect_listen.is_empty() {
+                let listen = SocketAddr::from_str(&tls.redirect_listen)?;
+                tls::spawn_redirect(listen, addr.port())?;
+            }
+            let handle = axum_server::Handle::new();
+            let listening = handle.clone();
+            tokio::spawn(async move {
+                if listening.listening().await.is_some() {
+                    systemd::notify("READY=1");
+                }
+            });
+            axum_server::bind_rustls(addr, config)
+                .handle(handle)
+                .serve(app.into_make_service_with_connect_info::<SocketAddr>())
+                .await?;
+        }
+        None => {
+            let server = axum::Server::try_bind(&addr)?;
+            systemd::notify("READY=1");
+            server
+                .serve(app.into_make_service_with_connect_info::<SocketAddr>())
+                .await?
+        }
+    }
+    Ok(())
+}
+
+async fn healthcheck(cfg: &Config) -> anyhow::Result<()> {
+    let mut addr = SocketAddr::from_str(&cfg.listen)?;
+    if addr.ip().is_unspecified() {
+        addr.set_ip(match addr {
+            SocketAddr::V4(_) => Ipv4Addr::LOCALHOST.into(),
+            SocketAddr::V6(_) => Ipv6Addr::LOCALHOST.into(),
+        });
+    }
+    let scheme = if cfg.tls.is_some() { "https" } else { "http" };
+    // The certificate is not issued for localhost
+    let res = reqwest::Client::builder()
+        .danger_accept_invalid_certs(true)
+        .timeout(Duration::from_secs(5))
+        .build()?
+        .get(format!("{}://{}/readyz", scheme, addr))
+        .send()
+        .await?;
+    if !res.status().is_success() {
+        return Err(anyhow::anyhow!("status {}", res.status()));
+    }
+    Ok(())
+}
+
+async fn health() -> &'static str {
+    "OK"
+}
+
 async fn metrics() -> String {
     metrics::ENCODER
         .encode_to_string(&metrics::REGISTRY.gather())
@@ -142,46 +354,140 @@ async fn static_handler(uri: Uri) -> impl IntoResponse {
 struct AppState {
     config: Config,
     paths: Arc<Manager>,
+    stream_tokens: StreamTokens,
+    auth_hook: Option<Arc<AuthHook>>,
+    stream_name: stream_name::Policy,
+    /// Serialize quota checked publishes and subscribes per tenant key
+    tenant_quotas: Arc<HashMap<String, Mutex<()>>>,
+}
+
+async fn whip_generate(State(state): State<AppState>) -> AppResult<Response<String>> {
+    let name = state
+        .stream_name
+        .generate()
+        .ok_or_else(|| anyhow::anyhow!("no generated stream name passes the rules"))?;
+    Ok(Response::builder()
+        .status(StatusCode::TEMPORARY_REDIRECT)
+        .header("Location", format!("/whip/{}", name))
+        .body("".to_string())?)
 }
 
 async fn whip(
     State(state): State<AppState>,
     Path(id): Path<String>,
+    ConnectInfo(addr): ConnectInfo<SocketAddr>,
     header: HeaderMap,
     uri: Uri,
     body: String,
 ) -> AppResult<Response<String>> {
+    // Cheap checks first, before the acl and the auth hook round trip
     let content_type = header
         .get("Content-Type")
-        .ok_or(anyhow::anyhow!("Content-Type is required"))?;
+        .ok_or(AppError::UnsupportedMediaType(
+            "Content-Type is required".to_string(),
+        ))?;
     if content_type.to_str()? != "application/sdp" {
-        return Err(anyhow::anyhow!("Content-Type must be application/sdp").into());
+        return Err(AppError::UnsupportedMediaType(
+            "Content-Type must be application/sdp".to_string(),
+        ));
     }
-    let offer = RTCSessionDescription::offer(body)?;
+    let offer =
+        RTCSessionDescription::offer(body).map_err(|e| AppError::BadRequest(e.to_string()))?;
+    state.stream_name.check(&id)?;
+    if !acl::allow(&state.config.acl, &id, Permission::Publish, addr.ip()) {
+        return Err(AppError::Forbidden("denied by acl".to_string()));
+    }
+    if let Some(hook) = &state.auth_hook {
+        if !hook
+            .allow(&id, Permission::Publish, addr.ip(), &header)
+            .await
+        {
+            return Err(AppError::Forbidden("denied by auth hook".to_string()));
+        }
+    }
+    // Held until published, concurrent publishes can't exceed the quota
+    let _quota = match auth::tenant(&state.config.auth.tenants, &header) {
+        Some(tenant) if tenant.max_streams != 0 => {
+            let quota = state.tenant_quotas[&tenant.key].lock().await;
+            let streams = state
+                .paths
+                .info(&tenant.prefix)
+                .await
+                .iter()
+                .filter(|i| i.publish_session.is_some())
+                .count();
+            if streams >= tenant.max_streams {
+                return Err(AppError::Forbidden(
+                    "tenant max_streams exceeded".to_string(),
+                ));
+            }
+            Some(quota)
+        }
+        _ => None,
+    };
     let (answer, key) = state.paths.publish(id, offer).await?;
-    Ok(Response::builder()
+    let mut builder = Response::builder()
         .status(StatusCode::CREATED)
         .header("Content-Type", "application/sdp")
         .header("Accept-Patch", "application/trickle-ice-sdpfrag")
         .header("E-Tag", key)
-        .header("Location", uri.to_string())
-        .body(answer.sdp)?)
+        .header("Location", uri.to_string());
+    for link in link_header(state.config.ice_servers.clone()) {
+        builder = builder.header("Link", link);
+    }
+    Ok(builder.body(answer.sdp)?)
 }
 
 async fn whep(
     State(state): State<AppState>,
     Path(id): Path<String>,
+    ConnectInfo(addr): ConnectInfo<SocketAddr>,
     header: HeaderMap,
     uri: Uri,
     body: String,
 ) -> AppResult<Response<String>> {
     let content_type = header
         .get("Content-Type")
-        .ok_or(anyhow::anyhow!("Content-Type is required"))?;
+        .ok_or(AppError::UnsupportedMediaType(
+            "Content-Type is required".to_string(),
+        ))?;
     if content_type.to_str()? != "application/sdp" {
-        return Err(anyhow::anyhow!("Content-Type must be application/sdp").into());
+        return Err(AppError::UnsupportedMediaType(
+            "Content-Type must be application/sdp".to_string(),
+        ));
     }
-    let offer = RTCSessionDescription::offer(body)?;
+    let offer =
+        RTCSessionDescription::offer(body).map_err(|e| AppError::BadRequest(e.to_string()))?;
+    if !acl::allow(&state.config.acl, &id, Permission::Subscribe, addr.ip()) {
+        return Err(AppError::Forbidden("denied by acl".to_string()));
+    }
+    if let Some(hook) = &state.auth_hook {
+        if !hook
+            .allow(&id, Permission::Subscribe, addr.ip(), &header)
+            .await
+        {
+            return Err(AppError::Forbidden("denied by auth hook".to_string()));
+        }
+    }
+    let _quota = match auth::tenant(&state.config.auth.tenants, &header) {
+        Some(tenant) if tenant.max_subscribers != 0 => {
+            let quota = state.tenant_quotas[&tenant.key].lock().await;
+            let subscribers: usize = state
+                .paths
+                .info(&tenant.prefix)
+                .await
+                .iter()
+                .map(|i| i.subscribe_sessions.len())
+                .sum();
+            if subscribers >= tenant.max_subscribers {
+                return Err(AppError::Forbidden(
+                    "tenant max_subscribers exceeded".to_string(),
+                ));
+            }
+            Some(quota)
+        }
+        _ => None,
+    };
     let (answer, key) = state.paths.subscribe(id.clone(), offer).await?;
     let mut builder = Response::builder()
         .status(StatusCode::CREATED)
@@ -189,12 +495,18 @@ async fn whep(
         .header("Accept-Patch", "application/trickle-ice-sdpfrag")
         .header("E-Tag", key)
         .header("Location", uri.to_string());
+    for link in link_header(state.config.ice_servers.clone()) {
+        builder = builder.header("Link", link);
+    }
     if state.paths.layers(id).await.is_ok() {
+        // Keep the signed URL query after `/layer`
+        let query = uri.query().map(|q| format!("?{}", q)).unwrap_or_default();
         builder = builder.header(
             "Link",
             format!(
-                "<{}/layer>; rel=\"urn:ietf:params:whep:ext:core:layer\"",
-                uri
+                "<{}/layer{}>; rel=\"urn:ietf:params:whep:ext:core:layer\"",
+                uri.path(),
+                query
             ),
         )
     }
@@ -209,9 +521,13 @@ async fn add_ice_candidate(
 ) -> AppResult<Response<String>> {
     let content_type = header
         .get("Content-Type")
-        .ok_or(AppError::from(anyhow::anyhow!("Content-Type is required")))?;
+        .ok_or(AppError::UnsupportedMediaType(
+            "Content-Type is required".to_string(),
+        ))?;
     if content_type.to_str()? != "application/trickle-ice-sdpfrag" {
-        return Err(anyhow::anyhow!("Content-Type must be application/trickle-ice-sdpfrag").into());
+        return Err(AppError::UnsupportedMediaType(
+            "Content-Type must be application/trickle-ice-sdpfrag".to_string(),
+        ));
     }
     let key = header
         .get("If-Match")
@@ -254,6 +570,101 @@ async fn ice_server_config(State(state): State<AppState>) -> AppResult<Response<
     Ok(builder.body("".to_owned())?)
 }
 
+async fn show_config(State(state): State<AppState>) -> Json<Config> {
+    Json(state.config.masked())
+}
+
+async fn streams(
+    State(state): State<AppState>,
+    Query(query): Query<QueryInfo>,
+) -> Json<Vec<ForwardInfo>> {
+    let infos = state.paths.info(&query.prefix).await;
+    Json(
+        infos
+            .into_iter()
+            .skip(query.offset)
+            .take(query.limit.unwrap_or(usize::MAX))
+            .collect(),
+    )
+}
+
+async fn delete_stream(
+    State(state): State<AppState>,
+    Path(stream): Path<String>,
+) -> AppResult<Response<String>> {
+    state.paths.remove_path(stream).await?;
+    Ok(Response::builder()
+        .status(StatusCode::NO_CONTENT)
+        .body("".to_string())?)
+}
+
+async fn delete_session(
+    State(state): State<AppState>,
+    Path((stream, session)): Path<(String, String)>,
+) -> AppResult<Response<String>> {
+    state.paths.remove_path_key(stream, session).await?;
+    Ok(Response::builder()
+        .status(StatusCode::NO_CONTENT)
+        .body("".to_string())?)
+}
+
+async fn events() -> Sse<impl Stream<Item = Result<SseEvent, Infallible>>> {
+    let stream = BroadcastStream::new(event::subscribe()).filter_map(|event| {
+        event
+            .ok()
+            .and_then(|event| SseEvent::default().json_data(event).ok())
+            .map(Ok)
+    });
+    Sse::new(stream).keep_alive(KeepAlive::default())
+}
+
+async fn events_history(Query(query): Query<QueryEvents>) -> Json<Vec<event::Event>> {
+    Json(event::history(query.since, query.kind.as_deref()))
+}
+
+async fn list_stream_tokens(State(state): State<AppState>) -> Json<Vec<StreamToken>> {
+    Json(state.stream_tokens.list())
+}
+
+async fn create_stream_token(
+    State(state): State<AppState>,
+    Json(req): Json<CreateStreamToken>,
+) -> Json<StreamToken> {
+    Json(
+        state
+            .stream_tokens
+            .create(req.stream, req.permission, req.ttl),
+    )
+}
+
+async fn delete_stream_token(
+    State(state): State<AppState>,
+    Path(token): Path<String>,
+) -> AppResult<Response<String>> {
+    if !state.stream_tokens.remove(&token) {
+        return Err(AppError::ResourceNotFound("token not exists".to_string()));
+    }
+    Ok(Response::builder()
+        .status(StatusCode::NO_CONTENT)
+        .body("".to_string())?)
+}
+
+async fn sign_url(
+    State(state): State<AppState>,
+    Json(req): Json<SignUrl>,
+) -> AppResult<Json<SignedUrl>> {
+    if state.config.auth.url_secret.is_empty() {
+        return Err(AppError::BadRequest(
+            "auth url_secret is not configured".to_string(),
+        ));
+    }
+    Ok(Json(auth::sign_url(
+        &state.config.auth.url_secret,
+        &req.stream,
+        req.ttl,
+    )))
+}
+
 async fn get_layer(
     State(state): State<AppState>,
     Path(id): Path<String>,
@@ -288,8 +699,7 @@ fn link_header(ice_servers: Vec<IceServer>) -> Vec<String> {
     ice_servers
         .into_iter()
         .flat_map(|server| {
-            let mut username = server.username;
-            let mut credential = server.credential;
+            let (mut username, mut credential) = server.credentials();
             if !username.is_empty() {
                 username = string_encoder(&username);
                 credential = string_encoder(&credential);
@@ -321,6 +731,12 @@ pub enum AppError {
     ResourceNotFound(String),
     #[error("resource already exists:{0}")]
     ResourceAlreadyExists(String),
+    #[error("bad request:{0}")]
+    BadRequest(String),
+    #[error("unsupported media type:{0}")]
+    UnsupportedMediaType(String),
+    #[error("forbidden:{0}")]
+    Forbidden(String),
     #[error("internal server error")]
     InternalServerError(anyhow::Error),
 }
@@ -337,6 +753,11 @@ impl IntoResponse for AppError {
             AppError::ResourceAlreadyExists(err) => {
                 (StatusCode::CONFLICT, err.to_string()).into_response()
             }
+            AppError::BadRequest(err) => (StatusCode::BAD_REQUEST, err.to_string()).into_response(),
+            AppError::UnsupportedMediaType(err) => {
+                (StatusCode::UNSUPPORTED_MEDIA_TYPE, err.to_string()).into_response()
+            }
+            AppError::Forbidden(err) => (StatusCode::FORBIDDEN, err.to_string()).into_response(),
         }
     }
 }
@@ -361,6 +782,9 @@ impl From<webrtc::Error> for AppError {
 
 impl From<anyhow::Error> for AppError {
     fn from(err: anyhow::Error) -> Self {
-        AppError::InternalServerError(err)
+        match err.downcast::<AppError>() {
+            Ok(err) => err,
+            Err(err) => AppError::InternalServerError(err),
+        }
     }
 }
@@ -3,25 +3,24 @@ use std::{collections::HashMap, sync::Arc};
 use anyhow::Result;
 use log::info;
 use tokio::sync::RwLock;
-use webrtc::{
-    ice_transport::ice_server::RTCIceServer,
-    peer_connection::sdp::session_description::RTCSessionDescription,
-};
+use webrtc::peer_connection::sdp::session_description::RTCSessionDescription;
 
-use crate::forward::info::Layer;
+use crate::config::IceServer;
+use crate::event::{self, EventKind};
+use crate::forward::info::{ForwardInfo, Layer};
 use crate::forward::PeerForward;
 use crate::AppError;
 
 #[derive(Clone)]
 pub struct Manager {
-    ice_servers: Vec<RTCIceServer>,
+    ice_servers: Vec<IceServer>,
     paths: Arc<RwLock<HashMap<String, PeerForward>>>,
 }
 
 pub type Response = (RTCSessionDescription, String);
 
 impl Manager {
-    pub fn new(ice_servers: Vec<RTCIceServer>) -> Self {
+    pub fn new(ice_servers: Vec<IceServer>) -> Self {
         Manager {
             ice_servers,
             paths: Default::default(),
@@ -33,7 +32,9 @@ impl Manager {
         let forward = paths.get(&path).cloned();
         drop(paths);
         if let Some(forward) = forward {
-            forward.set_anchor(offer).await
+            let response = forward.set_anchor(offer).await?;
+            self.remove_on_anchor_down(path, forward);
+            Ok(response)
         } else {
             let forward = PeerForward::new(path.clone(), self.ice_servers.clone());
             let (sdp, key) = forward.set_anchor(offer).await?;
@@ -42,11 +43,30 @@ impl Manager {
                 return Err(anyhow::anyhow!("resource already exists"));
             }
             info!("add path : {}", path);
-            paths.insert(path, forward);
+            event::emit(EventKind::StreamUp {
+                stream: path.clone(),
+            });
+            paths.insert(path.clone(), forward.clone());
+            drop(paths);
+            self.remove_on_anchor_down(path, forward);
             Ok((sdp, key))
         }
     }
 
+    /// A publisher gone without DELETE leaves no path behind
+    fn remove_on_anchor_down(&self, path: String, forward: PeerForward) {
+        let paths = self.paths.clone();
+        tokio::spawn(async move {
+            forward.wait_anchor_down().await;
+            let mut paths = paths.write().await;
+            if paths.get(&path).map_or(false, |f| f.same(&forward)) {
+                info!("remove path : {}", path);
+                paths.remove(&path);
+                event::emit(EventKind::StreamDown { stream: path });
+            }
+        });
+    }
+
     pub async fn subscribe(&self, path: String, offer: RTCSessionDescription) -> Result<Response> {
         let paths = self.paths.read().await;
         let forward = paths.get(&path).cloned();
@@ -82,17 +102,49 @@ impl Manager {
         let paths = self.paths.read().await;
         let forward = paths.get(&path).cloned();
         drop(paths);
-        if let Some(forward) = forward {
-            let is_publish = forward.remove_peer(key.clone()).await?;
-            if is_publish {
-                let mut paths = self.paths.write().await;
-                info!("remove path : {}", path);
-                paths.remove(&path);
-            }
+        let forward = forward
+            .ok_or_else(|| AppError::ResourceNotFound(format!("path {} not exists", path)))?;
+        let is_publish = forward.remove_peer(key.clone()).await?;
+        if is_publish {
+            let mut paths = self.paths.write().await;
+            info!("remove path : {}", path);
+            paths.remove(&path);
+            event::emit(EventKind::StreamDown { stream: path });
         }
         Ok(())
     }
 
+    pub async fn remove_path(&self, path: String) -> Result<()> {
+        let mut paths = self.paths.write().await;
+        let forward = paths.remove(&path);
+        drop(paths);
+        if let Some(forward) = forward {
+            info!("remove path : {}", path);
+            event::emit(EventKind::StreamDown {
+                stream: path.clone(),
+            });
+            forward.close().await
+        } else {
+            Err(AppError::ResourceNotFound(format!("path {} not exists", path)).into())
+        }
+    }
+
+    pub async fn info(&self, prefix: &str) -> Vec<ForwardInfo> {
+        let paths = self.paths.read().await;
+        let forwards: Vec<PeerForward> = paths
+            .iter()
+            .filter(|(path, _)| path.starts_with(prefix))
+            .map(|(_, forward)| forward.clone())
+            .collect();
+        drop(paths);
+        let mut infos = Vec::with_capacity(forwards.len());
+        for forward in forwards {
+            infos.push(forward.info().await);
+        }
+        infos.sort_by(|a, b| a.id.cmp(&b.id));
+        infos
+    }
+
     pub async fn layers(&self, path: String) -> Result<Vec<Layer>> {
         let paths = self.paths.read().await;
         let forward = paths.get(&path).cloned();
@@ -0,0 +1,116 @@
+use anyhow::Result;
+use rand::{distributions::Alphanumeric, Rng};
+use regex::Regex;
+
+use crate::config::StreamName;
+use crate::AppError;
+
+/// Rules checked on the stream name before publish
+#[derive(Debug, Clone)]
+pub struct Policy {
+    pattern: Option<Regex>,
+    max_length: usize,
+    reserved_prefixes: Vec<String>,
+}
+
+impl Policy {
+    pub fn new(cfg: &StreamName) -> Result<Self> {
+        let pattern = if cfg.pattern.is_empty() {
+            None
+        } else {
+            Some(Regex::new(&cfg.pattern)?)
+        };
+        Ok(Self {
+            pattern,
+            max_length: cfg.max_length,
+            reserved_prefixes: cfg.reserved_prefixes.clone(),
+        })
+    }
+
+    pub fn check(&self, name: &str) -> Result<()> {
+        if self.max_length != 0 && name.len() > self.max_length {
+            return Err(AppError::BadRequest(format!(
+                "stream name longer than {}",
+                self.max_length
+            ))
+            .into());
+        }
+        if let Some(pattern) = &self.pattern {
+            if !pattern.is_match(name) {
+                return Err(
+                    AppError::BadRequest(format!("stream name not match {}", pattern)).into(),
+                );
+            }
+        }
+        if let Some(prefix) = self
+            .reserved_prefixes
+            .iter()
+            .find(|prefix| name.starts_with(prefix.as_str()))
+        {
+            return Err(
+                AppError::Forbidden(format!("stream name prefix {} is reserved", prefix)).into(),
+            );
+        }
+        Ok(())
+    }
+
+    /// A random name passing `check`, None when every attempt is rejected
+    pub fn generate(&self) -> Option<String> {
+        (0..GENERATE_ATTEMPTS)
+            .map(|_| random_name())
+            .find(|name| self.check(name).is_ok())
+    }
+}
+
+/// Random names tried by `Policy::generate`
+const GENERATE_ATTEMPTS: usize = 64;
+
+fn random_name() -> String {
+    rand::thread_rng()
+        .sample_iter(&Alphanumeric)
+        .take(16)
+        .map(char::from)
+        .collect::<String>()
+        .to_lowercase()
+}
+
+#[cfg(test)]
+mod test {
+    use crate::config::StreamName;
+    use crate::stream_name::Policy;
+
+    #[test]
+    fn test_policy() {
+        let policy = Policy::new(&StreamName {
+            pattern: "^[a-z0-9-]+$".to_string(),
+            max_length: 8,
+            reserved_prefixes: vec!["live-".to_string()],
+            generate: true,
+        })
+        .unwrap();
+        assert!(policy.check("777").is_ok());
+        assert!(policy.check("777777777").is_err());
+        assert!(policy.check("Live").is_err());
+        assert!(policy.check("live-777").is_err());
+        assert!(policy.generate().is_none());
+
+        let policy = Policy::new(&StreamName {
+            pattern: "^[a-z0-9-]+$".to_string(),
+            max_length: 16,
+            reserved_prefixes: vec!["live-".to_string()],
+            generate: true,
+        })
+        .unwrap();
+        let name = policy.generate().unwrap();
+        assert!(policy.check(&name).is_ok());
+
+        let policy = Policy::new(&StreamName {
+            pattern: "^live-".to_string(),
+            max_length: 0,
+            reserved_prefixes: vec![],
+            generate: true,
+        })
+        .unwrap();
+        assert!(policy.generate().is_none());
+    }
+}
@@ -0,0 +1,58 @@
+//! Reference: https://www.freedesktop.org/software/systemd/man/sd_notify.html
+
+use std::time::Duration;
+
+/// Sends `state` to `$NOTIFY_SOCKET`, nothing to do when not started by systemd
+#[cfg(unix)]
+fn notify_impl(state: &str) {
+    use log::{debug, warn};
+    use std::env;
+    use std::os::unix::net::UnixDatagram;
+
+    let path = match env::var("NOTIFY_SOCKET") {
+        Ok(path) => path,
+        Err(_) => return,
+    };
+    let send = |socket: UnixDatagram| match path.strip_prefix('@') {
+        #[cfg(target_os = "linux")]
+        Some(name) => {
+            use std::os::linux::net::SocketAddrExt;
+            let addr = std::os::unix::net::SocketAddr::from_abstract_name(name)?;
+            socket.send_to_addr(state.as_bytes(), &addr)
+        }
+        _ => socket.send_to(state.as_bytes(), &path),
+    };
+    match UnixDatagram::unbound().and_then(send) {
+        Ok(_) => debug!("systemd notify {}", state),
+        Err(e) => warn!("systemd notify {} error: {}", state, e),
+    }
+}
+
+/// No systemd
+#[cfg(not(unix))]
+fn notify_impl(_state: &str) {}
+
+/// Half of `WatchdogSec`, None when the watchdog is disabled
+#[cfg(unix)]
+fn watchdog_interval_impl() -> Option<Duration> {
+    std::env::var("WATCHDOG_USEC")
+        .ok()
+        .and_then(|v| v.parse::<u64>().ok())
+        .filter(|usec| *usec > 0)
+        .map(|usec| Duration::from_micros(usec / 2))
+}
+
+/// No systemd
+#[cfg(not(unix))]
+fn watchdog_interval_impl() -> Option<Duration> {
+    None
+}
+
+pub(crate) fn notify(state: &str) {
+    notify_impl(state)
+}
+
+/// The main loop sends `WATCHDOG=1` at this interval
+pub(crate) fn watchdog_interval() -> Option<Duration> {
+    watchdog_interval_impl()
+}
@@ -0,0 +1,113 @@
+use std::fs::File;
+use std::io::BufReader;
+use std::net::SocketAddr;
+use std::str::FromStr;
+use std::sync::Arc;
+
+use anyhow::{anyhow, Result};
+use axum::extract::Host;
+use axum::http::uri::{Authority, Uri};
+use axum::response::Redirect;
+use axum::Router;
+use axum_server::tls_rustls::RustlsConfig;
+use log::{error, info};
+use rustls::version::{TLS12, TLS13};
+use rustls::{
+    Certificate, PrivateKey, ServerConfig, SupportedCipherSuite, SupportedProtocolVersion,
+    ALL_CIPHER_SUITES,
+};
+use rustls_pemfile::Item;
+
+use crate::config::Tls;
+
+/// Checks the settings that don't need the cert and key files
+pub(crate) fn validate(tls: &Tls) -> Result<()> {
+    protocol_versions(tls)?;
+    cipher_suites(tls)?;
+    if !tls.redirect_listen.is_empty() {
+        SocketAddr::from_str(&tls.redirect_listen)
+            .map_err(|e| anyhow!("tls redirect_listen {} : {}", tls.redirect_listen, e))?;
+    }
+    Ok(())
+}
+
+pub(crate) fn rustls_config(tls: &Tls) -> Result<RustlsConfig> {
+    let mut config = ServerConfig::builder()
+        .with_cipher_suites(&cipher_suites(tls)?)
+        .with_safe_default_kx_groups()
+        .with_protocol_versions(&protocol_versions(tls)?)?
+        .with_no_client_auth()
+        .with_single_cert(load_certs(&tls.cert)?, load_key(&tls.key)?)?;
+    config.alpn_protocols = vec![b"http/1.1".to_vec()];
+    Ok(RustlsConfig::from_config(Arc::new(config)))
+}
+
+fn protocol_versions(tls: &Tls) -> Result<Vec<&'static SupportedProtocolVersion>> {
+    match tls.min_version.as_str() {
+        "" | "1.2" => Ok(vec![&TLS12, &TLS13]),
+        "1.3" => Ok(vec![&TLS13]),
+        v => Err(anyhow!("unsupported tls min_version: {}", v)),
+    }
+}
+
+fn cipher_suites(tls: &Tls) -> Result<Vec<SupportedCipherSuite>> {
+    if tls.cipher_suites.is_empty() {
+        return Ok(ALL_CIPHER_SUITES.to_vec());
+    }
+    tls.cipher_suites
+        .iter()
+        .map(|name| {
+            ALL_CIPHER_SUITES
+                .iter()
+                .find(|s| format!("{:?}", s.suite()) == *name)
+                .cloned()
+                .ok_or_else(|| anyhow!("unsupported tls cipher_suite: {}", name))
+        })
+        .collect()
+}
+
+fn load_certs(path: &str) -> Result<Vec<Certificate>> {
+    let mut reader = BufReader::new(File::open(path)?);
+    let certs = rustls_pemfile::certs(&mut reader)?;
+    if certs.is_empty() {
+        return Err(anyhow!("no certificate found in {}", path));
+    }
+    Ok(certs.into_iter().map(Certificate).collect())
+}
+
+fn load_key(path: &str) -> Result<PrivateKey> {
+    let mut reader = BufReader::new(File::open(path)?);
+    loop {
+        match rustls_pemfile::read_one(&mut reader)? {
+            Some(Item::PKCS8Key(key)) | Some(Item::RSAKey(key)) | Some(Item::ECKey(key)) => {
+                return Ok(PrivateKey(key))
+            }
+            Some(_) => {}
+            None => return Err(anyhow!("no private key found in {}", path)),
+        }
+    }
+}
+
+/// Plain HTTP listener, only redirect to HTTPS. Binds before spawning, a taken port is an error
+pub(crate) fn spawn_redirect(listen: SocketAddr, https_port: u16) -> Result<()> {
+    let app = Router::new().fallback(move |Host(host): Host, uri: Uri| async move {
+        let host = host
+            .parse::<Authority>()
+            .map(|authority| authority.host().to_string())
+            .unwrap_or(host);
+        let path = uri.path_and_query().map(|p| p.as_str()).unwrap_or("/");
+        if https_port == 443 {
+            Redirect::permanent(&format!("https://{}{}", host, path))
+        } else {
+            Redirect::permanent(&format!("https://{}:{}{}", host, https_port, path))
+        }
+    });
+    let server = axum::Server::try_bind(&listen)?;
+    info!("Redirect HTTP listening on {}", listen);
+    tokio::spawn(async move {
+        if let Err(e) = server.serve(app.into_make_service()).await {
+            error!("Redirect HTTP error: {e}");
+        }
+    });
+    Ok(())
+}